@@ -8,7 +8,10 @@ This implementation is adapted from the Google batch API
 https://github.com/terraform-providers/terraform-provider-google/blob/master/google/batcher.go
 
 However there are a number of notable differences
-- Usage assumes 1 batcher for 1 API (instead of 1 batcher for multiple APIs)
+- A single RequestBatcher can serve multiple logical APIs at once via the
+  batchKey argument to SendRequestWithTimeout, batching requests that
+  share a key together while keeping each key's flush lifecycle
+  independent
 - Clients should only receive their own response, and not the batch response
   their request is sent with
 - Config conventions follow the framework as defined in
@@ -19,12 +22,23 @@ package batcher
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math/rand"
 	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracer is the OpenTelemetry tracer used for per-request and per-batch
+// spans.
+var tracer = otel.Tracer("github.com/mingruimingrui/batcher")
+
 /*
 RequestBatcher handles receiving of new requests, and all the background
 asynchronous tasks to batch and send batch.
@@ -41,7 +55,25 @@ type RequestBatcher struct {
 	*BatchingConfig
 	running   bool
 	parentCtx context.Context
-	curBatch  *startedBatch
+
+	// batches holds the batch currently accumulating for each batchKey.
+	// A key with no accumulating batch is absent from the map rather than
+	// mapped to nil.
+	batches map[string]*startedBatch
+
+	// sendSem bounds the number of batches that may be in flight to SendF
+	// at once. nil when MaxConcurrentBatches is unset, meaning unbounded.
+	sendSem chan struct{}
+
+	// inFlight holds every batch that has been dispatched to
+	// SendF/SendFV2 but hasn't finished delivering to all its
+	// subscribers yet, so Shutdown can forcibly release any left waiting
+	// once its context expires.
+	inFlight map[*startedBatch]struct{}
+
+	// wg tracks in-flight send goroutines, so Shutdown can wait for them
+	// to finish.
+	wg sync.WaitGroup
 }
 
 /*
@@ -51,32 +83,543 @@ type BatchingConfig struct {
 	// Maximum request size of each batch.
 	MaxBatchSize int
 
+	// Maximum aggregate byte size of a batch's request bodies, as measured
+	// by SizeOfFunc. When appending a request would exceed this, the
+	// current batch is flushed immediately and the request starts a new
+	// one. Zero disables this limit.
+	MaxBatchBytes int
+
+	// Maximum aggregate byte size of the response SendF returns for a
+	// batch, as measured by SizeOfFunc. When exceeded, subscribers of that
+	// batch receive ErrResponseTooLarge instead of their share of the
+	// response. Zero disables this limit.
+	MaxResponseBytes int
+
 	// Maximum wait time before batch should be executed.
 	BatchTimeout time.Duration
 
+	// Policy decides when a partially filled batch should be flushed and
+	// how long a newly started batch should idle for more requests before
+	// that happens. Defaults to a SizeTimeoutPolicy built from
+	// MaxBatchSize, MaxBatchBytes and BatchTimeout, reproducing the
+	// behaviour of a RequestBatcher with Policy left unset.
+	Policy BatchPolicy
+
+	// Maximum number of batches that may be in flight to SendF at the same
+	// time. Zero (the default) leaves this unbounded. When the limit is
+	// reached, further flushed batches wait for a free slot before being
+	// sent; new batches keep accumulating in the meantime.
+	MaxConcurrentBatches int
+
+	// RetryPolicy governs retrying a batch against SendF/SendFV2 when it
+	// fails with a retryable error. Nil (the default) disables retries,
+	// so a failed batch fails its subscribers immediately, same as a
+	// RequestBatcher without RetryPolicy configured.
+	RetryPolicy *RetryPolicy
+
 	// User defined SendF for sending a batch request.
 	// See SendFunc for type definition of this function.
 	SendF SendFunc
+
+	// SendFV2 is a partial-failure aware alternative to SendF. When set,
+	// it is used in place of SendF, and individual requests within a
+	// batch may fail independently. See SendFuncV2.
+	SendFV2 SendFuncV2
+
+	// SizeOfFunc measures the byte size of a single request or response
+	// body for the purpose of enforcing MaxBatchBytes and
+	// MaxResponseBytes. Defaults to defaultSizeOf, which measures []byte
+	// values directly and JSON-marshals everything else.
+	SizeOfFunc SizeOfFunc
+
+	// Observer receives lifecycle events for metrics and tracing.
+	// Defaults to a no-op Observer. See PrometheusObserver for a ready
+	// made implementation.
+	Observer Observer
 }
 
 /*
-SendFunc is a function type for sending a batch of requests.
-A batch of requests is a slice of inputs to SendRequestWithTimeout.
+SendFunc is a function type for sending a batch of requests. batchKey
+identifies which logical API the batch belongs to, as passed to
+SendRequestWithTimeout; body is a slice of inputs to
+SendRequestWithTimeout for that key.
 */
-type SendFunc func(body *[]interface{}) (*[]interface{}, error)
+type SendFunc func(batchKey string, body *[]interface{}) (*[]interface{}, error)
+
+/*
+ItemResult is a single entry of the slice returned by a SendFuncV2,
+reporting the outcome of one request within the batch. Body is delivered
+to the owning subscriber when Err is nil; otherwise Err is delivered in
+its place.
+*/
+type ItemResult struct {
+	Body interface{}
+	Err  error
+}
+
+/*
+SendFuncV2 is a partial-failure aware alternative to SendFunc. It
+receives a per-batch context, derived from the RequestBatcher's parent
+context with a deadline equal to the earliest deadline among the
+batch's requests, and the batchKey the batch was accumulated under, and returns one ItemResult per
+request in body, in the same order, so a single bad element does not
+have to fail the rest of the batch. Returning a non-nil error fails every
+request in the batch, same as SendFunc.
+*/
+type SendFuncV2 func(ctx context.Context, batchKey string, body []interface{}) ([]ItemResult, error)
+
+/*
+SizeOfFunc is a function type for measuring the byte size of a single
+request or response body, used to enforce MaxBatchBytes and
+MaxResponseBytes.
+*/
+type SizeOfFunc func(interface{}) int
+
+// defaultSizeOf is the default SizeOfFunc. []byte values are measured
+// directly; everything else is measured by probing the length of its
+// JSON encoding, so non-[]byte payloads can still participate in byte
+// size limits.
+func defaultSizeOf(v interface{}) int {
+	if b, ok := v.([]byte); ok {
+		return len(b)
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// ErrResponseTooLarge is delivered to subscribers in place of their
+// response when the aggregate response SendF returned for their batch
+// exceeds BatchingConfig.MaxResponseBytes.
+type ErrResponseTooLarge struct {
+	// Size is the measured aggregate response size.
+	Size int
+
+	// MaxSize is the MaxResponseBytes limit that was exceeded.
+	MaxSize int
+}
+
+func (e *ErrResponseTooLarge) Error() string {
+	return fmt.Sprintf(
+		"Response size %v exceeds MaxResponseBytes %v", e.Size, e.MaxSize,
+	)
+}
+
+/*
+RetryPolicy controls retrying a batch against SendF/SendFV2 when it fails
+outright (as opposed to an ItemResult-level per-item error, which is
+never retried). Backoff between attempts grows from InitialBackoff by
+Multiplier up to MaxBackoff, with up to Jitter extra as a fraction of the
+current backoff to avoid thundering-herd retries.
+*/
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times SendF/SendFV2 is called
+	// for a batch before giving up. Values <= 1 disable retries.
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the second attempt.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps how long the backoff may grow to. Zero disables the
+	// cap.
+	MaxBackoff time.Duration
+
+	// Multiplier scales the backoff after each failed attempt.
+	Multiplier float64
+
+	// Jitter is the maximum extra fraction of the current backoff added
+	// at random, e.g. 0.1 for up to 10% jitter.
+	Jitter float64
+
+	// Retryable classifies whether err should be retried. Nil treats
+	// every error as retryable.
+	Retryable func(err error) bool
+
+	// OnDeadLetter is called with the batch's request body and the final
+	// error once retries are exhausted (or the error was not retryable),
+	// so callers can persist the batch for later replay.
+	OnDeadLetter func(body []interface{}, err error)
+}
+
+// FlushReason identifies why a batch was flushed, for reporting to
+// Observer.OnBatchFlushed.
+type FlushReason string
+
+const (
+	// FlushReasonSize means the batch reached MaxBatchSize/MaxBatchBytes,
+	// or was flushed to make room for a request that no longer fit.
+	FlushReasonSize FlushReason = "size"
+
+	// FlushReasonTimeout means the Policy decided the batch had waited
+	// long enough to flush, either when its idle timer fired or when a
+	// request was appended to it without reaching a hard size cap.
+	FlushReasonTimeout FlushReason = "timeout"
+
+	// FlushReasonShutdown means the batch was flushed because the
+	// RequestBatcher was shutting down.
+	FlushReasonShutdown FlushReason = "shutdown"
+)
+
+/*
+Observer receives lifecycle events from a RequestBatcher, for metrics and
+tracing purposes. Implementations must be safe for concurrent use and
+should return promptly, as every method is called inline, either on the
+goroutine calling SendRequestWithTimeout or Shutdown, or on the
+RequestBatcher's own background goroutines. See PrometheusObserver for a ready made
+implementation that exports these events to Prometheus.
+*/
+type Observer interface {
+	// OnRequestEnqueued is called once a request has been appended to a
+	// batch, either a new one or one already accumulating.
+	OnRequestEnqueued()
+
+	// OnBatchFlushed is called once a batch has been handed off to
+	// SendF/SendFV2, reporting why it was flushed and how many requests
+	// it held.
+	OnBatchFlushed(reason FlushReason, size int)
+
+	// OnBatchSent is called once SendF/SendFV2 has returned for a batch
+	// (after any retries), reporting its size, how long the call took,
+	// and its final error, if any.
+	OnBatchSent(size int, latency time.Duration, err error)
+
+	// OnRequestCompleted is called once a subscriber's response has been
+	// delivered, reporting the time from when the request was enqueued
+	// to delivery, and its error, if any.
+	OnRequestCompleted(latency time.Duration, err error)
+}
+
+// noopObserver is the default Observer, used when BatchingConfig.Observer
+// is left unset.
+type noopObserver struct{}
+
+func (noopObserver) OnRequestEnqueued()                                     {}
+func (noopObserver) OnBatchFlushed(reason FlushReason, size int)            {}
+func (noopObserver) OnBatchSent(size int, latency time.Duration, err error) {}
+func (noopObserver) OnRequestCompleted(latency time.Duration, err error)    {}
+
+/*
+PrometheusObserver is an Observer that exports batching metrics to
+Prometheus: histograms of batch size, batch fill ratio
+(size/MaxBatchSize), queue-wait latency (from a request being enqueued to
+its response being delivered) and send latency, plus a counter of
+flushes broken down by FlushReason. Construct one with
+NewPrometheusObserver, register it with a prometheus.Registerer, and
+assign it to BatchingConfig.Observer.
+*/
+type PrometheusObserver struct {
+	maxBatchSize int
+
+	batchSize      prometheus.Histogram
+	batchFillRatio prometheus.Histogram
+	queueWait      prometheus.Histogram
+	sendLatency    prometheus.Histogram
+	flushesTotal   *prometheus.CounterVec
+}
+
+var (
+	_ Observer             = (*PrometheusObserver)(nil)
+	_ prometheus.Collector = (*PrometheusObserver)(nil)
+)
+
+// NewPrometheusObserver creates a PrometheusObserver. namespace is used
+// as the Prometheus metric namespace; maxBatchSize should match the
+// RequestBatcher's BatchingConfig.MaxBatchSize so batch fill ratio is
+// measured correctly.
+func NewPrometheusObserver(namespace string, maxBatchSize int) *PrometheusObserver {
+	return &PrometheusObserver{
+		maxBatchSize: maxBatchSize,
+
+		batchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "batch_size",
+			Help:      "Number of requests in a flushed batch.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		}),
+		batchFillRatio: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "batch_fill_ratio",
+			Help:      "Fraction of MaxBatchSize a flushed batch reached.",
+			Buckets:   prometheus.LinearBuckets(0.1, 0.1, 10),
+		}),
+		queueWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "queue_wait_seconds",
+			Help:      "Time a request spent between being enqueued and its response being delivered.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		sendLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "send_latency_seconds",
+			Help:      "Time SendF/SendFV2 took to return for a batch, including retries.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		flushesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "flushes_total",
+			Help:      "Number of batches flushed, broken down by reason.",
+		}, []string{"reason"}),
+	}
+}
+
+func (o *PrometheusObserver) Describe(ch chan<- *prometheus.Desc) {
+	o.batchSize.Describe(ch)
+	o.batchFillRatio.Describe(ch)
+	o.queueWait.Describe(ch)
+	o.sendLatency.Describe(ch)
+	o.flushesTotal.Describe(ch)
+}
+
+func (o *PrometheusObserver) Collect(ch chan<- prometheus.Metric) {
+	o.batchSize.Collect(ch)
+	o.batchFillRatio.Collect(ch)
+	o.queueWait.Collect(ch)
+	o.sendLatency.Collect(ch)
+	o.flushesTotal.Collect(ch)
+}
+
+func (o *PrometheusObserver) OnRequestEnqueued() {}
+
+func (o *PrometheusObserver) OnBatchFlushed(reason FlushReason, size int) {
+	o.batchSize.Observe(float64(size))
+	if o.maxBatchSize > 0 {
+		o.batchFillRatio.Observe(float64(size) / float64(o.maxBatchSize))
+	}
+	o.flushesTotal.WithLabelValues(string(reason)).Inc()
+}
+
+func (o *PrometheusObserver) OnBatchSent(size int, latency time.Duration, err error) {
+	o.sendLatency.Observe(latency.Seconds())
+}
+
+func (o *PrometheusObserver) OnRequestCompleted(latency time.Duration, err error) {
+	o.queueWait.Observe(latency.Seconds())
+}
+
+/*
+Batch is a read-only snapshot of a batch in progress, passed to a
+BatchPolicy so it can decide whether and when to flush without reaching
+into RequestBatcher internals.
+*/
+type Batch struct {
+	// Size is the number of requests currently held by the batch.
+	Size int
+
+	// Bytes is the aggregate SizeOfFunc size of the batch's request
+	// bodies.
+	Bytes int
+
+	// Age is how long the batch has been accumulating requests.
+	Age time.Duration
+}
+
+/*
+BatchPolicy decides when a batch should be flushed.
+
+ShouldFlush is consulted both right after a request is appended to a
+batch (to allow an eager flush once a batch is "full" by whatever
+definition the policy uses) and when a batch's idle timer fires (to
+decide whether the elapsed wait is enough to flush, or whether the batch
+should keep waiting). NextTimeout supplies the idle wait to arm when a
+batch is started, and to re-arm with whenever ShouldFlush declines to
+flush a batch whose timer just fired. OnBatchSent is called once a batch
+has been handed off to SendF, so policies that adapt to recent traffic
+can update their internal state.
+*/
+type BatchPolicy interface {
+	// ShouldFlush reports whether batch should be flushed now.
+	ShouldFlush(batch Batch) bool
+
+	// NextTimeout returns how long a batch should idle for more requests
+	// before its idle timer fires again.
+	NextTimeout(batch Batch) time.Duration
+
+	// OnBatchSent notifies the policy that batch has been flushed and
+	// handed to SendF.
+	OnBatchSent(batch Batch)
+}
+
+/*
+SizeTimeoutPolicy is the default BatchPolicy. It flushes a batch as soon
+as it reaches MaxBatchSize requests or MaxBatchBytes bytes, or once
+BatchTimeout has elapsed since the batch was started. This reproduces the
+behaviour of a RequestBatcher configured without an explicit Policy.
+*/
+type SizeTimeoutPolicy struct {
+	MaxBatchSize  int
+	MaxBatchBytes int
+	BatchTimeout  time.Duration
+}
+
+func (p *SizeTimeoutPolicy) ShouldFlush(batch Batch) bool {
+	if p.MaxBatchSize > 0 && batch.Size >= p.MaxBatchSize {
+		return true
+	}
+	if p.MaxBatchBytes > 0 && batch.Bytes >= p.MaxBatchBytes {
+		return true
+	}
+	return p.BatchTimeout > 0 && batch.Age >= p.BatchTimeout
+}
+
+func (p *SizeTimeoutPolicy) NextTimeout(batch Batch) time.Duration {
+	return p.BatchTimeout
+}
+
+func (p *SizeTimeoutPolicy) OnBatchSent(batch Batch) {}
+
+/*
+MinBatchSizePolicy withholds a batch until it holds at least MinBatchSize
+requests, similar to TF-Serving's batch_timeout_micros combined with a
+non-zero minimum batch size: an idle timer firing before MinBatchSize is
+reached is ignored and the batch keeps waiting. Once MinBatchSize is met,
+the batch flushes on reaching MaxBatchSize or after BatchTimeout, same as
+SizeTimeoutPolicy.
+*/
+type MinBatchSizePolicy struct {
+	MinBatchSize int
+	MaxBatchSize int
+	BatchTimeout time.Duration
+}
+
+func (p *MinBatchSizePolicy) ShouldFlush(batch Batch) bool {
+	if batch.Size < p.MinBatchSize {
+		return false
+	}
+	if p.MaxBatchSize > 0 && batch.Size >= p.MaxBatchSize {
+		return true
+	}
+	return batch.Age >= p.BatchTimeout
+}
+
+func (p *MinBatchSizePolicy) NextTimeout(batch Batch) time.Duration {
+	return p.BatchTimeout
+}
+
+func (p *MinBatchSizePolicy) OnBatchSent(batch Batch) {}
+
+/*
+AdaptiveTimeoutPolicy grows or shrinks its effective BatchTimeout based on
+recent batch fill: when batches are consistently reaching MaxBatchSize
+before their timer fires, traffic is heavy enough to sustain a shorter
+wait, so the timeout shrinks towards MinTimeout; when batches flush on
+timeout without filling up, the timeout grows towards MaxTimeout to give
+slower traffic more time to accumulate. Use NewAdaptiveTimeoutPolicy to
+construct one.
+*/
+type AdaptiveTimeoutPolicy struct {
+	MaxBatchSize int
+	MinTimeout   time.Duration
+	MaxTimeout   time.Duration
+
+	// Step is the fraction by which the effective timeout is adjusted
+	// after each batch, e.g. 0.1 for a 10% adjustment.
+	Step float64
+
+	mu      sync.Mutex
+	timeout time.Duration
+}
+
+// NewAdaptiveTimeoutPolicy creates an AdaptiveTimeoutPolicy, starting at
+// MaxTimeout so the policy only shrinks once it has observed batches
+// filling up.
+func NewAdaptiveTimeoutPolicy(
+	maxBatchSize int,
+	minTimeout, maxTimeout time.Duration,
+	step float64,
+) *AdaptiveTimeoutPolicy {
+	return &AdaptiveTimeoutPolicy{
+		MaxBatchSize: maxBatchSize,
+		MinTimeout:   minTimeout,
+		MaxTimeout:   maxTimeout,
+		Step:         step,
+		timeout:      maxTimeout,
+	}
+}
+
+func (p *AdaptiveTimeoutPolicy) currentTimeout() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.timeout
+}
+
+func (p *AdaptiveTimeoutPolicy) ShouldFlush(batch Batch) bool {
+	if p.MaxBatchSize > 0 && batch.Size >= p.MaxBatchSize {
+		return true
+	}
+	return batch.Age >= p.currentTimeout()
+}
+
+func (p *AdaptiveTimeoutPolicy) NextTimeout(batch Batch) time.Duration {
+	return p.currentTimeout()
+}
+
+func (p *AdaptiveTimeoutPolicy) OnBatchSent(batch Batch) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	factor := 1 + p.Step
+	if p.MaxBatchSize > 0 && batch.Size >= p.MaxBatchSize {
+		factor = 1 - p.Step
+	}
+
+	next := time.Duration(float64(p.timeout) * factor)
+	if next < p.MinTimeout {
+		next = p.MinTimeout
+	}
+	if next > p.MaxTimeout {
+		next = p.MaxTimeout
+	}
+	p.timeout = next
+}
 
 // startedBatch refers to a batch awaiting for more requests to come in
 // before having SendFunc applied to it's content
 type startedBatch struct {
+	// batchKey is the key this batch accumulated under, passed to
+	// SendF/SendFV2 so it knows which logical API the batch is for.
+	batchKey string
+
 	// Combined batch request
 	body []interface{}
 
+	// bodyBytes is the aggregate SizeOfFunc size of body, kept up to date
+	// incrementally so MaxBatchBytes can be checked without rescanning
+	// body on every request.
+	bodyBytes int
+
 	// subscribers is a registry of the requests (batchSubscriber)
 	// combined to make this batch
 	subscribers []batchSubscriber
 
-	// timer for keeping track of BatchTimeout
+	// startTime records when the batch was created, so its Age can be
+	// reported to BatchPolicy.
+	startTime time.Time
+
+	// timer for keeping track of the idle wait before the batch is
+	// reconsidered for flushing
 	timer *time.Timer
+
+	// deliveryMu guards delivered, so a slow in-flight send and
+	// Shutdown's forced release can't both deliver to the same
+	// subscriber.
+	deliveryMu sync.Mutex
+
+	// delivered tracks, by subscriber index, which subscribers have
+	// already received a response. Allocated once the batch is
+	// dispatched to SendF/SendFV2.
+	delivered []bool
+}
+
+// view returns the read-only Batch snapshot of batch for BatchPolicy.
+func (batch *startedBatch) view() Batch {
+	return Batch{
+		Size:  len(batch.body),
+		Bytes: batch.bodyBytes,
+		Age:   time.Since(batch.startTime),
+	}
 }
 
 // singleResponse represents a single response received from SendF
@@ -90,6 +633,20 @@ type batchSubscriber struct {
 	// singleRequestBody is the original request this subscriber represents
 	singleRequestBody interface{}
 
+	// deadline is when this subscriber's SendRequestWithTimeout call gives
+	// up waiting. Used to derive the per-batch context passed to
+	// SendFuncV2.
+	deadline time.Time
+
+	// enqueuedAt records when this subscriber was registered, so
+	// Observer.OnRequestCompleted can report how long it waited.
+	enqueuedAt time.Time
+
+	// spanCtx carries the OpenTelemetry span started for this request in
+	// SendRequestWithTimeout, so the batch's send span can link back to
+	// it.
+	spanCtx context.Context
+
 	// respCh is the channel created to communicate the result to a waiting
 	// goroutine
 	respCh chan *singleResponse
@@ -110,35 +667,119 @@ func NewRequestBatcher(
 		BatchingConfig: config,
 		parentCtx:      ctx,
 		running:        true,
+		batches:        make(map[string]*startedBatch),
+		inFlight:       make(map[*startedBatch]struct{}),
+	}
+
+	if batcher.SendF == nil && batcher.SendFV2 == nil {
+		log.Fatal("Expecting SendF or SendFV2")
+	}
+
+	if batcher.SizeOfFunc == nil {
+		batcher.SizeOfFunc = defaultSizeOf
+	}
+
+	if batcher.Policy == nil {
+		batcher.Policy = &SizeTimeoutPolicy{
+			MaxBatchSize:  batcher.MaxBatchSize,
+			MaxBatchBytes: batcher.MaxBatchBytes,
+			BatchTimeout:  batcher.BatchTimeout,
+		}
+	}
+
+	if batcher.Observer == nil {
+		batcher.Observer = noopObserver{}
 	}
 
-	if batcher.SendF == nil {
-		log.Fatal("Expecting SendF")
+	if batcher.MaxConcurrentBatches > 0 {
+		batcher.sendSem = make(chan struct{}, batcher.MaxConcurrentBatches)
 	}
 
 	go func(b *RequestBatcher) {
 		<-b.parentCtx.Done()
 		log.Printf("Parent context cancelled")
-		b.stop()
+		// The parent context carries no useful deadline of its own once
+		// it's already done, so drain with a fresh, unbounded context
+		// rather than one that would expire immediately.
+		if err := b.Shutdown(context.Background()); err != nil {
+			log.Printf("[ERROR] Error during shutdown: %v", err)
+		}
 	}(batcher)
 
 	return batcher
 }
 
-// stop would safely releases all batcher allocated resources
-func (b *RequestBatcher) stop() {
-	b.Lock()
-	defer b.Unlock()
-	log.Println("Stopping batcher")
+// ErrShuttingDown is delivered to a subscriber still waiting on a
+// response once a RequestBatcher's Shutdown deadline expires before its
+// batch finished sending.
+var ErrShuttingDown = fmt.Errorf("batcher: request batcher is shutting down")
 
+/*
+Shutdown stops the RequestBatcher from accepting new requests, flushes
+every batch currently accumulating through SendF/SendFV2, and waits for
+all in-flight sends to finish or for ctx to expire, whichever comes
+first. Subscribers whose batch finishes sending before ctx expires
+receive their real response, same as under normal operation; any
+subscriber still waiting once ctx expires instead receives
+ErrShuttingDown. Calling Shutdown more than once, or after the
+RequestBatcher has already stopped via its parent context being
+cancelled, is a no-op that returns nil.
+*/
+func (b *RequestBatcher) Shutdown(ctx context.Context) error {
+	b.Lock()
+	if !b.running {
+		b.Unlock()
+		return nil
+	}
 	b.running = false
-	if b.curBatch != nil {
-		b.curBatch.timer.Stop()
-		for i := len(b.curBatch.subscribers) - 1; i >= 0; i-- {
-			close(b.curBatch.subscribers[i].respCh)
+
+	batches := b.batches
+	b.batches = make(map[string]*startedBatch)
+	flushedSizes := make([]int, 0, len(batches))
+	for _, batch := range batches {
+		batch.timer.Stop()
+		flushedSizes = append(flushedSizes, len(batch.body))
+		b.sendAsync(batch)
+	}
+	b.Unlock()
+
+	// Reported outside the lock so a slow Observer can't stall every
+	// batchKey's registerRequest.
+	for _, size := range flushedSizes {
+		b.Observer.OnBatchFlushed(FlushReasonShutdown, size)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		b.releaseInFlight()
+		return ctx.Err()
+	}
+}
+
+// releaseInFlight delivers ErrShuttingDown to every subscriber of a
+// still in-flight batch that hasn't received a response yet. Used by
+// Shutdown once its context expires.
+func (b *RequestBatcher) releaseInFlight() {
+	b.Lock()
+	inFlight := make([]*startedBatch, 0, len(b.inFlight))
+	for batch := range b.inFlight {
+		inFlight = append(inFlight, batch)
+	}
+	b.Unlock()
+
+	for _, batch := range inFlight {
+		for i := range batch.subscribers {
+			b.deliver(batch, i, &singleResponse{err: ErrShuttingDown})
 		}
 	}
-	log.Println("Batcher stopped")
 }
 
 /*
@@ -147,6 +788,10 @@ It manages registering the request into the batcher,
 and waiting on the response.
 
 Arguments:
+	batchKey {string} -- Identifies which logical API newRequestBody
+		belongs to. Requests sharing a batchKey are batched together;
+		a RequestBatcher serving a single API can pass the same
+		constant batchKey (e.g. "") for every call.
 	newRequestBody {*interface{}} -- A request body. SendF will expect
 		a slice of objects like newRequestBody.
 
@@ -156,6 +801,7 @@ Returns:
 	error       -- Error
 */
 func (b *RequestBatcher) SendRequestWithTimeout(
+	batchKey string,
 	newRequestBody *interface{},
 	timeout time.Duration,
 ) (interface{}, error) {
@@ -172,139 +818,466 @@ func (b *RequestBatcher) SendRequestWithTimeout(
 		return nil, fmt.Errorf(errmsg)
 	}
 
-	respCh, err := b.registerRequest(newRequestBody)
+	spanCtx, span := tracer.Start(
+		b.parentCtx, "batcher.request",
+		trace.WithAttributes(attribute.String("batcher.batch_key", batchKey)),
+	)
+	defer span.End()
+
+	respCh, err := b.registerRequest(spanCtx, batchKey, newRequestBody, timeout)
 	if err != nil {
+		span.RecordError(err)
+		if err == ErrShuttingDown {
+			return nil, err
+		}
 		log.Printf("[ERROR] Failed to register request: %v", err)
 		return nil, fmt.Errorf("Failed to register request")
 	}
 
-	ctx, cancel := context.WithTimeout(b.parentCtx, timeout)
+	ctx, cancel := context.WithTimeout(spanCtx, timeout)
 	defer cancel()
 
 	select {
-	case resp := <-respCh:
+	case resp, ok := <-respCh:
+		if !ok {
+			err := ErrShuttingDown
+			span.RecordError(err)
+			return nil, err
+		}
 		if resp.err != nil {
 			log.Printf("[ERROR] Failed to process request: %v", resp.err)
+			span.RecordError(resp.err)
 			return nil, resp.err
 		}
 		return resp.body, nil
 
 	case <-ctx.Done():
-		return nil, fmt.Errorf("Request timeout after %v", timeout)
+		err := fmt.Errorf("Request timeout after %v", timeout)
+		span.RecordError(err)
+		return nil, err
 	}
 }
 
-// registerRequest safely determines if new request should be
-// added to existing batch or to a new batch
+// registerRequest safely determines if new request should be added to
+// the batchKey's existing batch or to a new one.
 func (b *RequestBatcher) registerRequest(
+	ctx context.Context,
+	batchKey string,
 	newRequestBody *interface{},
+	timeout time.Duration,
 ) (<-chan *singleResponse, error) {
 	respCh := make(chan *singleResponse, 1)
 	sub := batchSubscriber{
 		singleRequestBody: *newRequestBody,
+		deadline:          time.Now().Add(timeout),
+		enqueuedAt:        time.Now(),
+		spanCtx:           ctx,
 		respCh:            respCh,
 	}
 
+	reqBytes := b.SizeOfFunc(*newRequestBody)
+
 	b.Lock()
-	defer b.Unlock()
 
-	if b.curBatch != nil {
+	if !b.running {
+		b.Unlock()
+		return nil, ErrShuttingDown
+	}
+
+	flushedSize, flushed, reason := 0, false, FlushReasonSize
+
+	if curBatch, exists := b.batches[batchKey]; exists {
 		// Check if new request can be appended to curBatch
-		if len(b.curBatch.body) < b.MaxBatchSize {
+		fitsCount := len(curBatch.body) < b.MaxBatchSize
+		fitsBytes := b.MaxBatchBytes <= 0 ||
+			curBatch.bodyBytes+reqBytes <= b.MaxBatchBytes
+
+		if fitsCount && fitsBytes {
 			// Append request to current batch
-			b.curBatch.body = append(b.curBatch.body, *newRequestBody)
-			b.curBatch.subscribers = append(b.curBatch.subscribers, sub)
-
-			// Check if current batch is full
-			if len(b.curBatch.body) >= b.MaxBatchSize {
-				// Send current batch
-				b.curBatch.timer.Stop()
-				b.sendCurBatch()
+			curBatch.body = append(curBatch.body, *newRequestBody)
+			curBatch.bodyBytes += reqBytes
+			curBatch.subscribers = append(curBatch.subscribers, sub)
+
+			// Let the policy decide if the batch should be flushed now
+			// that it has grown
+			if b.Policy.ShouldFlush(curBatch.view()) {
+				curBatch.timer.Stop()
+				reason = b.eagerFlushReason(curBatch.view())
+				flushedSize, flushed = b.flushBatch(batchKey)
 			}
 
+			b.Unlock()
+
+			// Reported outside the lock so a slow Observer can't stall
+			// every batchKey's registerRequest.
+			b.Observer.OnRequestEnqueued()
+			if flushed {
+				b.Observer.OnBatchFlushed(reason, flushedSize)
+			}
 			return respCh, nil
 		}
 
 		// Send current batch
-		b.curBatch.timer.Stop()
-		b.sendCurBatch()
+		curBatch.timer.Stop()
+		flushedSize, flushed = b.flushBatch(batchKey)
 	}
 
 	// Create new batch from request
-	b.curBatch = &startedBatch{
-		body:        []interface{}{*newRequestBody},
-		subscribers: []batchSubscriber{sub},
-	}
+	b.startBatch(batchKey, newRequestBody, reqBytes, sub)
 
-	// Start a timer to send request after batch timeout
-	b.curBatch.timer = time.AfterFunc(b.BatchTimeout, b.sendCurBatchWithSafety)
+	b.Unlock()
 
+	// Reported outside the lock so a slow Observer can't stall every
+	// batchKey's registerRequest.
+	b.Observer.OnRequestEnqueued()
+	if flushed {
+		b.Observer.OnBatchFlushed(FlushReasonSize, flushedSize)
+	}
 	return respCh, nil
 }
 
-// sendCurBatch pops curBatch and sends it without mutex
-func (b *RequestBatcher) sendCurBatch() {
-	// Acquire batch
-	batch := b.curBatch
-	b.curBatch = nil
+// startBatch creates a new accumulating batch for batchKey from a single
+// request and arms its idle timer. Callers must hold b.Lock.
+func (b *RequestBatcher) startBatch(batchKey string, newRequestBody *interface{}, reqBytes int, sub batchSubscriber) {
+	batch := &startedBatch{
+		batchKey:    batchKey,
+		body:        []interface{}{*newRequestBody},
+		bodyBytes:   reqBytes,
+		subscribers: []batchSubscriber{sub},
+		startTime:   time.Now(),
+	}
+	batch.timer = time.AfterFunc(
+		b.Policy.NextTimeout(batch.view()),
+		func() { b.onBatchIdle(batchKey) },
+	)
+	b.batches[batchKey] = batch
+}
 
-	if batch != nil {
-		go func() {
-			b.send(batch)
-		}()
+// eagerFlushReason reports whether an eager post-append flush of view
+// should be attributed to FlushReasonSize or FlushReasonTimeout.
+// BatchPolicy.ShouldFlush gives no indication of why it returned true, so
+// this checks the request-level MaxBatchSize/MaxBatchBytes hard caps;
+// anything else (e.g. AdaptiveTimeoutPolicy or MinBatchSizePolicy
+// deciding a batch is old enough) is attributed to FlushReasonTimeout
+// instead of unconditionally FlushReasonSize.
+func (b *RequestBatcher) eagerFlushReason(view Batch) FlushReason {
+	if b.MaxBatchSize > 0 && view.Size >= b.MaxBatchSize {
+		return FlushReasonSize
 	}
+	if b.MaxBatchBytes > 0 && view.Bytes >= b.MaxBatchBytes {
+		return FlushReasonSize
+	}
+	return FlushReasonTimeout
 }
 
-// sendCurBatchWithSafety pops curBatch and sends it with mutex
-func (b *RequestBatcher) sendCurBatchWithSafety() {
-	// Acquire batch
+// onBatchIdle runs when batchKey's idle timer fires. It flushes the
+// batch if the policy agrees enough time has passed, or re-arms the
+// timer with the policy's next requested wait otherwise (used by
+// policies like MinBatchSizePolicy that withhold a flush until a minimum
+// size is met).
+func (b *RequestBatcher) onBatchIdle(batchKey string) {
 	b.Lock()
-	batch := b.curBatch
-	b.curBatch = nil
+
+	batch, exists := b.batches[batchKey]
+	if !exists {
+		b.Unlock()
+		return
+	}
+
+	if b.Policy.ShouldFlush(batch.view()) {
+		size, _ := b.flushBatch(batchKey)
+		b.Unlock()
+		// Reported outside the lock so a slow Observer can't stall every
+		// batchKey's registerRequest.
+		b.Observer.OnBatchFlushed(FlushReasonTimeout, size)
+		return
+	}
+
+	batch.timer = time.AfterFunc(
+		b.Policy.NextTimeout(batch.view()),
+		func() { b.onBatchIdle(batchKey) },
+	)
 	b.Unlock()
+}
 
-	if batch != nil {
-		go func() {
-			b.send(batch)
+// flushBatch pops batchKey's accumulating batch, if any, out of
+// b.batches and dispatches it to SendF/SendFV2. Callers must hold
+// b.Lock, and are responsible for reporting the flush to
+// Observer.OnBatchFlushed themselves (after releasing the lock) using
+// the returned size, so a slow Observer can't stall every batchKey's
+// registerRequest.
+func (b *RequestBatcher) flushBatch(batchKey string) (size int, flushed bool) {
+	batch, exists := b.batches[batchKey]
+	if !exists {
+		return 0, false
+	}
+	delete(b.batches, batchKey)
+	b.sendAsync(batch)
+	return len(batch.body), true
+}
+
+// sendAsync dispatches batch to SendF on its own goroutine, gated by
+// sendSem so at most MaxConcurrentBatches batches are ever in flight at
+// once, and tracked so Shutdown can wait for it or forcibly release its
+// subscribers. Callers must hold b.Lock.
+func (b *RequestBatcher) sendAsync(batch *startedBatch) {
+	batch.delivered = make([]bool, len(batch.subscribers))
+	b.inFlight[batch] = struct{}{}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer func() {
+			b.Lock()
+			delete(b.inFlight, batch)
+			b.Unlock()
 		}()
+
+		if b.sendSem != nil {
+			b.sendSem <- struct{}{}
+			defer func() { <-b.sendSem }()
+		}
+		b.send(batch)
+	}()
+}
+
+// deliver sends resp to batch's i'th subscriber and closes its respCh,
+// unless it has already received a response (e.g. Shutdown racing a
+// slow send), and reports the subscriber's total queue-wait-to-completion
+// latency to Observer.
+func (b *RequestBatcher) deliver(batch *startedBatch, i int, resp *singleResponse) {
+	batch.deliveryMu.Lock()
+	if batch.delivered[i] {
+		batch.deliveryMu.Unlock()
+		return
+	}
+	batch.delivered[i] = true
+	batch.deliveryMu.Unlock()
+
+	sub := batch.subscribers[i]
+	sub.respCh <- resp
+	close(sub.respCh)
+	b.Observer.OnRequestCompleted(time.Since(sub.enqueuedAt), resp.err)
+}
+
+// rejectAll delivers err to every subscriber of batch and closes their
+// respCh.
+func (b *RequestBatcher) rejectAll(batch *startedBatch, err error) {
+	for i := len(batch.subscribers) - 1; i >= 0; i-- {
+		b.deliver(batch, i, &singleResponse{body: nil, err: err})
+	}
+}
+
+// sendWithRetry invokes attempt, retrying it per b.RetryPolicy, and
+// returns the final error (nil on success). attempt should perform one
+// SendF/SendFV2 call and return its error, if any. A subscriber whose
+// own deadline elapses mid-retry is released by its own per-request
+// timeout in SendRequestWithTimeout; sendWithRetry does not release
+// subscribers early.
+func (b *RequestBatcher) sendWithRetry(
+	batch *startedBatch, attempt func() error,
+) error {
+	policy := b.RetryPolicy
+	if policy == nil {
+		return attempt()
+	}
+
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+
+	backoff := policy.InitialBackoff
+	var err error
+	for n := 1; n <= maxAttempts; n++ {
+		err = attempt()
+		if err == nil {
+			return nil
+		}
+
+		if policy.Retryable != nil && !policy.Retryable(err) {
+			break
+		}
+		if n == maxAttempts {
+			break
+		}
+
+		wait := backoff
+		if policy.Jitter > 0 {
+			wait += time.Duration(rand.Float64() * policy.Jitter * float64(backoff))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-b.parentCtx.Done():
+			timer.Stop()
+		}
+
+		backoff = time.Duration(float64(backoff) * policy.Multiplier)
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+
+	if policy.OnDeadLetter != nil {
+		policy.OnDeadLetter(batch.body, err)
+	}
+	return err
+}
+
+// batchDeadline derives the context to pass to SendFuncV2: ctx bounded by
+// the earliest deadline among batch's subscribers, so a backend can
+// honor whichever caller is closest to giving up.
+func (b *RequestBatcher) batchDeadline(ctx context.Context, batch *startedBatch) (context.Context, context.CancelFunc) {
+	earliest := batch.subscribers[0].deadline
+	for _, sub := range batch.subscribers[1:] {
+		if sub.deadline.Before(earliest) {
+			earliest = sub.deadline
+		}
 	}
+	return context.WithDeadline(ctx, earliest)
 }
 
-// send calls SendF on a startedBatch
+// batchLinks builds the OpenTelemetry links from each subscriber's
+// per-request span to the batch span about to be started, so a trace
+// viewer can navigate from the batch span back to the individual
+// requests it was sent on behalf of.
+func batchLinks(batch *startedBatch) []trace.Link {
+	links := make([]trace.Link, 0, len(batch.subscribers))
+	for _, sub := range batch.subscribers {
+		if sub.spanCtx == nil {
+			continue
+		}
+		if sc := trace.SpanContextFromContext(sub.spanCtx); sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
+	return links
+}
+
+// send calls SendF or SendFV2 on a startedBatch
 func (b *RequestBatcher) send(batch *startedBatch) {
+	view := batch.view()
+	defer b.Policy.OnBatchSent(view)
+
+	spanCtx, span := tracer.Start(
+		b.parentCtx, "batcher.send",
+		trace.WithLinks(batchLinks(batch)...),
+		trace.WithAttributes(
+			attribute.String("batcher.batch_key", batch.batchKey),
+			attribute.Int("batcher.batch_size", len(batch.body)),
+		),
+	)
+	defer span.End()
+
+	if b.SendFV2 != nil {
+		b.sendV2(spanCtx, batch)
+		return
+	}
 
-	// Attempt to apply SendF
-	batchResp, err := b.SendF(&batch.body)
+	// Attempt to apply SendF, retrying per RetryPolicy on failure.
+	start := time.Now()
+	var batchResp *[]interface{}
+	err := b.sendWithRetry(batch, func() error {
+		var attemptErr error
+		batchResp, attemptErr = b.SendF(batch.batchKey, &batch.body)
+		return attemptErr
+	})
+	b.Observer.OnBatchSent(len(batch.body), time.Since(start), err)
 	if err != nil {
-		for i := len(batch.subscribers) - 1; i >= 0; i-- {
-			batch.subscribers[i].respCh <- &singleResponse{
-				body: nil,
-				err:  err,
-			}
-			close(batch.subscribers[i].respCh)
-		}
+		span.RecordError(err)
+		b.rejectAll(batch, err)
 		return
 	}
 
 	// Raise error if number of entries mismatch
 	if len(*batchResp) != len(batch.body) {
 		log.Printf("[ERROR] SendF returned different number of entries.")
-		for i := len(batch.subscribers) - 1; i >= 0; i-- {
-			batch.subscribers[i].respCh <- &singleResponse{
-				body: nil,
-				err:  fmt.Errorf("API error"),
-			}
-			close(batch.subscribers[i].respCh)
-		}
+		b.rejectAll(batch, fmt.Errorf("API error"))
 		return
 	}
 
+	// Reject the response if it exceeds MaxResponseBytes, rather than
+	// delivering a payload the caller never agreed to receive.
+	if b.MaxResponseBytes > 0 {
+		respBytes := 0
+		for _, item := range *batchResp {
+			respBytes += b.SizeOfFunc(item)
+		}
+
+		if respBytes > b.MaxResponseBytes {
+			log.Printf(
+				"[ERROR] Response size %v exceeds MaxResponseBytes %v",
+				respBytes, b.MaxResponseBytes,
+			)
+			b.rejectAll(batch, &ErrResponseTooLarge{
+				Size:    respBytes,
+				MaxSize: b.MaxResponseBytes,
+			})
+			return
+		}
+	}
+
 	// On success, place response into subscribed response queues.
 	for i := len(batch.subscribers) - 1; i >= 0; i-- {
-		batch.subscribers[i].respCh <- &singleResponse{
-			body: (*batchResp)[i],
-			err:  nil,
+		b.deliver(batch, i, &singleResponse{body: (*batchResp)[i]})
+	}
+}
+
+// sendV2 calls SendFV2 on a startedBatch, routing each ItemResult to only
+// its owning subscriber instead of failing the whole batch on one bad
+// element. ctx is the batch's send span context, from send.
+func (b *RequestBatcher) sendV2(ctx context.Context, batch *startedBatch) {
+	sendCtx, cancel := b.batchDeadline(ctx, batch)
+	defer cancel()
+
+	start := time.Now()
+	var results []ItemResult
+	err := b.sendWithRetry(batch, func() error {
+		var attemptErr error
+		results, attemptErr = b.SendFV2(sendCtx, batch.batchKey, batch.body)
+		return attemptErr
+	})
+	b.Observer.OnBatchSent(len(batch.body), time.Since(start), err)
+	if err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+		b.rejectAll(batch, err)
+		return
+	}
+
+	// Raise error if number of entries mismatch
+	if len(results) != len(batch.body) {
+		log.Printf("[ERROR] SendFV2 returned different number of entries.")
+		b.rejectAll(batch, fmt.Errorf("API error"))
+		return
+	}
+
+	// Reject the response if it exceeds MaxResponseBytes, rather than
+	// delivering a payload the caller never agreed to receive.
+	if b.MaxResponseBytes > 0 {
+		respBytes := 0
+		for _, item := range results {
+			respBytes += b.SizeOfFunc(item.Body)
 		}
-		close(batch.subscribers[i].respCh)
+
+		if respBytes > b.MaxResponseBytes {
+			log.Printf(
+				"[ERROR] Response size %v exceeds MaxResponseBytes %v",
+				respBytes, b.MaxResponseBytes,
+			)
+			b.rejectAll(batch, &ErrResponseTooLarge{
+				Size:    respBytes,
+				MaxSize: b.MaxResponseBytes,
+			})
+			return
+		}
+	}
+
+	// On success, each subscriber receives only its own ItemResult.
+	for i := len(batch.subscribers) - 1; i >= 0; i-- {
+		b.deliver(batch, i, &singleResponse{
+			body: results[i].Body,
+			err:  results[i].Err,
+		})
 	}
 }
@@ -3,24 +3,43 @@ package batcher
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"math/rand"
+	"sync"
 	"testing"
 	"time"
 )
 
 var (
-	ctx              context.Context
-	delayedBatcher   *RequestBatcher
-	immediateBatcher *RequestBatcher
+	ctx                   context.Context
+	delayedBatcher        *RequestBatcher
+	immediateBatcher      *RequestBatcher
+	partialFailureBatcher *RequestBatcher
 
 	idleTimeout         time.Duration
 	nonEmptyRequestBody interface{}
 )
 
-func dummySendF(body *[]interface{}) (*[]interface{}, error) {
+func dummySendF(batchKey string, body *[]interface{}) (*[]interface{}, error) {
 	return body, nil
 }
 
+// oddRejectingSendFV2 fails odd integers and echoes back everything else,
+// so tests can exercise SendFuncV2's per-item error routing.
+func oddRejectingSendFV2(
+	ctx context.Context, batchKey string, body []interface{},
+) ([]ItemResult, error) {
+	results := make([]ItemResult, len(body))
+	for i, item := range body {
+		if n, ok := item.(int); ok && n%2 != 0 {
+			results[i] = ItemResult{Err: fmt.Errorf("odd value rejected: %v", n)}
+			continue
+		}
+		results[i] = ItemResult{Body: item}
+	}
+	return results, nil
+}
+
 func init() {
 	ctx = context.Background()
 
@@ -36,6 +55,12 @@ func init() {
 		SendF:        dummySendF,
 	})
 
+	partialFailureBatcher = NewRequestBatcher(ctx, &BatchingConfig{
+		MaxBatchSize: 2,
+		BatchTimeout: time.Millisecond,
+		SendFV2:      oddRejectingSendFV2,
+	})
+
 	idleTimeout = time.Minute
 	nonEmptyRequestBody = "This is some string"
 }
@@ -84,7 +109,7 @@ func TestValidRequestBody(t *testing.T) {
 	}
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
-			resp, err := delayedBatcher.SendRequestWithTimeout(&tC.body, idleTimeout)
+			resp, err := delayedBatcher.SendRequestWithTimeout("", &tC.body, idleTimeout)
 
 			// Ensure no error
 			if err != nil {
@@ -109,7 +134,7 @@ func TestValidRequestBody(t *testing.T) {
 
 // TestInvalidRequestBody checks if RequestBatcher rejects invalid requests
 func TestInvalidRequestBody(t *testing.T) {
-	_, err := delayedBatcher.SendRequestWithTimeout(nil, idleTimeout)
+	_, err := delayedBatcher.SendRequestWithTimeout("", nil, idleTimeout)
 	if err == nil {
 		t.Error("Expecting error when sending with `nil` body")
 	}
@@ -118,7 +143,7 @@ func TestInvalidRequestBody(t *testing.T) {
 // TestTimeoutTooShort checks if timeouts that are too short are rejected
 func TestTimeoutTooShort(t *testing.T) {
 	_, err := delayedBatcher.SendRequestWithTimeout(
-		&nonEmptyRequestBody,
+		"", &nonEmptyRequestBody,
 		delayedBatcher.BatchTimeout,
 	)
 	if err == nil {
@@ -129,6 +154,422 @@ func TestTimeoutTooShort(t *testing.T) {
 	}
 }
 
+// TestSendFuncV2PartialFailure checks that a rejected item within a batch
+// only fails its own subscriber, leaving the rest of the batch
+// unaffected.
+func TestSendFuncV2PartialFailure(t *testing.T) {
+	var goodResp, badResp interface{}
+	var goodErr, badErr error
+	done := make(chan struct{}, 2)
+
+	good := interface{}(2)
+	bad := interface{}(3)
+
+	go func() {
+		goodResp, goodErr = partialFailureBatcher.SendRequestWithTimeout("", &good, idleTimeout)
+		done <- struct{}{}
+	}()
+	go func() {
+		badResp, badErr = partialFailureBatcher.SendRequestWithTimeout("", &bad, idleTimeout)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+
+	if goodErr != nil {
+		t.Errorf("Unexpected error for even value: %v", goodErr)
+	}
+	if goodResp != good {
+		t.Errorf("Expecting %v, got %v", good, goodResp)
+	}
+	if badErr == nil {
+		t.Error("Expecting error for odd value")
+	}
+	if badResp != nil {
+		t.Errorf("Expecting no response for rejected item, got %v", badResp)
+	}
+}
+
+// TestBatchKeyIsolation checks that requests made under different
+// batchKeys are routed to SendF as separate batches, even when made
+// concurrently against the same RequestBatcher.
+func TestBatchKeyIsolation(t *testing.T) {
+	var mu sync.Mutex
+	batchesSeen := map[string]int{}
+
+	keyedBatcher := NewRequestBatcher(ctx, &BatchingConfig{
+		MaxBatchSize: 32,
+		BatchTimeout: 10 * time.Millisecond,
+		SendF: func(batchKey string, body *[]interface{}) (*[]interface{}, error) {
+			mu.Lock()
+			batchesSeen[batchKey] += len(*body)
+			mu.Unlock()
+			return body, nil
+		},
+	})
+
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b"} {
+		key := key
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				body := interface{}(key)
+				resp, err := keyedBatcher.SendRequestWithTimeout(key, &body, idleTimeout)
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				if resp != key {
+					t.Errorf("Expecting %v, got %v", key, resp)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if batchesSeen["a"] != 5 || batchesSeen["b"] != 5 {
+		t.Errorf("Expecting 5 requests per key, got %v", batchesSeen)
+	}
+}
+
+// TestRetryPolicyDeadLetter checks that a batch which keeps failing is
+// retried up to MaxAttempts and, once exhausted, hands the batch to
+// OnDeadLetter and fails its subscriber.
+func TestRetryPolicyDeadLetter(t *testing.T) {
+	var attempts int
+	var deadLetteredBody []interface{}
+	var deadLetterErr error
+	wantErr := fmt.Errorf("backend unavailable")
+
+	retryingBatcher := NewRequestBatcher(ctx, &BatchingConfig{
+		MaxBatchSize: 32,
+		BatchTimeout: time.Millisecond,
+		SendF: func(batchKey string, body *[]interface{}) (*[]interface{}, error) {
+			attempts++
+			return nil, wantErr
+		},
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+			Multiplier:     1,
+			OnDeadLetter: func(body []interface{}, err error) {
+				deadLetteredBody = body
+				deadLetterErr = err
+			},
+		},
+	})
+
+	body := interface{}("retry me")
+	_, err := retryingBatcher.SendRequestWithTimeout("", &body, idleTimeout)
+
+	if attempts != 3 {
+		t.Errorf("Expecting 3 attempts, got %v", attempts)
+	}
+	if err != wantErr {
+		t.Errorf("Expecting %v, got %v", wantErr, err)
+	}
+	if deadLetterErr != wantErr {
+		t.Errorf("Expecting OnDeadLetter error %v, got %v", wantErr, deadLetterErr)
+	}
+	if len(deadLetteredBody) != 1 || deadLetteredBody[0] != body {
+		t.Errorf("Expecting dead-lettered body [%v], got %v", body, deadLetteredBody)
+	}
+}
+
+// fakeObserver records Observer calls for TestObserverReceivesLifecycleEvents.
+type fakeObserver struct {
+	mu        sync.Mutex
+	enqueued  int
+	flushed   []FlushReason
+	sent      int
+	completed int
+}
+
+func (o *fakeObserver) OnRequestEnqueued() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.enqueued++
+}
+
+func (o *fakeObserver) OnBatchFlushed(reason FlushReason, size int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.flushed = append(o.flushed, reason)
+}
+
+func (o *fakeObserver) OnBatchSent(size int, latency time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sent++
+}
+
+func (o *fakeObserver) OnRequestCompleted(latency time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.completed++
+}
+
+// TestObserverReceivesLifecycleEvents checks that a configured Observer
+// is notified as a request is enqueued, its batch flushed on timeout,
+// sent, and completed.
+func TestObserverReceivesLifecycleEvents(t *testing.T) {
+	observer := &fakeObserver{}
+	observedBatcher := NewRequestBatcher(ctx, &BatchingConfig{
+		MaxBatchSize: 32,
+		BatchTimeout: time.Millisecond,
+		SendF:        dummySendF,
+		Observer:     observer,
+	})
+
+	body := interface{}("observe me")
+	if _, err := observedBatcher.SendRequestWithTimeout("", &body, idleTimeout); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// OnBatchFlushed and OnRequestCompleted may be reported after the
+	// response has already been handed to SendRequestWithTimeout, so wait
+	// for them instead of racing its return.
+	deadline := time.Now().Add(time.Second)
+	for {
+		observer.mu.Lock()
+		reported := len(observer.flushed) > 0 && observer.completed > 0
+		observer.mu.Unlock()
+		if reported || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	if observer.enqueued != 1 {
+		t.Errorf("Expecting 1 enqueued event, got %v", observer.enqueued)
+	}
+	if len(observer.flushed) != 1 || observer.flushed[0] != FlushReasonTimeout {
+		t.Errorf("Expecting 1 timeout flush, got %v", observer.flushed)
+	}
+	if observer.sent != 1 {
+		t.Errorf("Expecting 1 sent event, got %v", observer.sent)
+	}
+	if observer.completed != 1 {
+		t.Errorf("Expecting 1 completed event, got %v", observer.completed)
+	}
+}
+
+// TestShutdownFlushesPendingBatch checks that Shutdown flushes a batch
+// still accumulating, delivers its subscriber a real response, and
+// rejects any further request with ErrShuttingDown.
+func TestShutdownFlushesPendingBatch(t *testing.T) {
+	shutdownBatcher := NewRequestBatcher(context.Background(), &BatchingConfig{
+		MaxBatchSize: 32,
+		BatchTimeout: 10 * time.Second,
+		SendF:        dummySendF,
+	})
+
+	body := interface{}("flush me")
+	done := make(chan struct{})
+	var resp interface{}
+	var err error
+	go func() {
+		resp, err = shutdownBatcher.SendRequestWithTimeout("", &body, idleTimeout)
+		close(done)
+	}()
+
+	// Give the request a moment to register before shutting down.
+	time.Sleep(10 * time.Millisecond)
+
+	if shutdownErr := shutdownBatcher.Shutdown(context.Background()); shutdownErr != nil {
+		t.Fatalf("Unexpected Shutdown error: %v", shutdownErr)
+	}
+	<-done
+
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if resp != body {
+		t.Errorf("Expecting %v, got %v", body, resp)
+	}
+
+	if _, err := shutdownBatcher.SendRequestWithTimeout("", &body, idleTimeout); err != ErrShuttingDown {
+		t.Errorf("Expecting ErrShuttingDown after Shutdown, got %v", err)
+	}
+}
+
+// TestShutdownContextExpiryReleasesSlowSend checks that a subscriber
+// whose batch is still sending when Shutdown's context expires receives
+// ErrShuttingDown instead of hanging.
+func TestShutdownContextExpiryReleasesSlowSend(t *testing.T) {
+	unblock := make(chan struct{})
+	slowBatcher := NewRequestBatcher(context.Background(), &BatchingConfig{
+		MaxBatchSize: 32,
+		BatchTimeout: 10 * time.Second,
+		SendF: func(batchKey string, body *[]interface{}) (*[]interface{}, error) {
+			<-unblock
+			return body, nil
+		},
+	})
+	defer close(unblock)
+
+	body := interface{}("slow")
+	done := make(chan struct{})
+	var err error
+	go func() {
+		_, err = slowBatcher.SendRequestWithTimeout("", &body, idleTimeout)
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if shutdownErr := slowBatcher.Shutdown(shutdownCtx); shutdownErr == nil {
+		t.Error("Expecting Shutdown to report a context deadline error")
+	}
+	<-done
+
+	if err != ErrShuttingDown {
+		t.Errorf("Expecting ErrShuttingDown, got %v", err)
+	}
+}
+
+// TestMaxBatchBytesTriggersEarlyFlush checks that a batch is flushed as
+// soon as appending another request would exceed MaxBatchBytes, even
+// though MaxBatchSize hasn't been reached yet.
+func TestMaxBatchBytesTriggersEarlyFlush(t *testing.T) {
+	var mu sync.Mutex
+	var batchSizes []int
+
+	// Each request body JSON-encodes to 3 bytes (quoted single digit
+	// string), so a MaxBatchBytes of 7 allows 2 requests per batch but
+	// not 3.
+	bytesBatcher := NewRequestBatcher(ctx, &BatchingConfig{
+		MaxBatchSize:  32,
+		MaxBatchBytes: 7,
+		BatchTimeout:  50 * time.Millisecond,
+		SendF: func(batchKey string, body *[]interface{}) (*[]interface{}, error) {
+			mu.Lock()
+			batchSizes = append(batchSizes, len(*body))
+			mu.Unlock()
+			return body, nil
+		},
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := interface{}(fmt.Sprintf("%v", i))
+			if _, err := bytesBatcher.SendRequestWithTimeout("", &body, idleTimeout); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+		// Give each request a moment to register before sending the next,
+		// so the batch fills up in a deterministic order.
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(batchSizes) != 2 {
+		t.Fatalf("Expecting 2 batches (flushed early on byte cap), got %v", batchSizes)
+	}
+	if batchSizes[0] != 2 || batchSizes[1] != 1 {
+		t.Errorf("Expecting batch sizes [2 1], got %v", batchSizes)
+	}
+}
+
+// TestResponseTooLargeRejected checks that SendRequestWithTimeout returns
+// an *ErrResponseTooLarge when the aggregate response SendF returns for
+// a batch exceeds MaxResponseBytes.
+func TestResponseTooLargeRejected(t *testing.T) {
+	responseBatcher := NewRequestBatcher(ctx, &BatchingConfig{
+		MaxBatchSize:     32,
+		MaxResponseBytes: 4,
+		BatchTimeout:     time.Millisecond,
+		SendF: func(batchKey string, body *[]interface{}) (*[]interface{}, error) {
+			resp := []interface{}{"too long a response"}
+			return &resp, nil
+		},
+	})
+
+	body := interface{}("hi")
+	_, err := responseBatcher.SendRequestWithTimeout("", &body, idleTimeout)
+	tooLarge, ok := err.(*ErrResponseTooLarge)
+	if !ok {
+		t.Fatalf("Expecting *ErrResponseTooLarge, got %v (%T)", err, err)
+	}
+	if tooLarge.MaxSize != 4 {
+		t.Errorf("Expecting MaxSize 4, got %v", tooLarge.MaxSize)
+	}
+	if tooLarge.Size <= tooLarge.MaxSize {
+		t.Errorf("Expecting Size > MaxSize, got Size %v MaxSize %v", tooLarge.Size, tooLarge.MaxSize)
+	}
+}
+
+// TestMaxConcurrentBatchesBoundsInFlightSends checks that no more than
+// MaxConcurrentBatches batches are ever dispatched to SendF at once.
+func TestMaxConcurrentBatchesBoundsInFlightSends(t *testing.T) {
+	const maxConcurrent = 2
+
+	var mu sync.Mutex
+	var current, peak int
+	unblock := make(chan struct{})
+
+	boundedBatcher := NewRequestBatcher(ctx, &BatchingConfig{
+		MaxBatchSize:         1,
+		MaxConcurrentBatches: maxConcurrent,
+		BatchTimeout:         time.Millisecond,
+		SendF: func(batchKey string, body *[]interface{}) (*[]interface{}, error) {
+			mu.Lock()
+			current++
+			if current > peak {
+				peak = current
+			}
+			mu.Unlock()
+
+			<-unblock
+
+			mu.Lock()
+			current--
+			mu.Unlock()
+			return body, nil
+		},
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := interface{}("x")
+			if _, err := boundedBatcher.SendRequestWithTimeout("", &body, idleTimeout); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+	}
+
+	// Give every batch a chance to start (and, if the bound were broken,
+	// to overshoot it) before releasing them.
+	time.Sleep(50 * time.Millisecond)
+	close(unblock)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if peak > maxConcurrent {
+		t.Errorf("Expecting at most %v concurrent sends, observed %v", maxConcurrent, peak)
+	}
+	if peak < maxConcurrent {
+		t.Errorf("Expecting sends to reach the %v-way bound, observed peak of %v", maxConcurrent, peak)
+	}
+}
+
 // BenchmarkSendRequestOverhead benchmarks the overhead costs of the
 // RequestBatcher
 func BenchmarkSendRequestOverhead(b *testing.B) {
@@ -137,7 +578,7 @@ func BenchmarkSendRequestOverhead(b *testing.B) {
 		for pb.Next() {
 			reqBody = rand.Float32()
 			resp, err := immediateBatcher.SendRequestWithTimeout(
-				&reqBody, idleTimeout)
+				"", &reqBody, idleTimeout)
 			if err != nil {
 				b.Errorf("Unexpected error: %v", err)
 			}
@@ -148,6 +589,55 @@ func BenchmarkSendRequestOverhead(b *testing.B) {
 	})
 }
 
+// TestMinBatchSizePolicyWithholdsUntilMinSize checks that
+// MinBatchSizePolicy refuses to flush a batch that hasn't reached
+// MinBatchSize yet, even once BatchTimeout has elapsed.
+func TestMinBatchSizePolicyWithholdsUntilMinSize(t *testing.T) {
+	policy := &MinBatchSizePolicy{
+		MinBatchSize: 4,
+		MaxBatchSize: 8,
+		BatchTimeout: time.Millisecond,
+	}
+
+	tooSmall := Batch{Size: 2, Age: time.Hour}
+	if policy.ShouldFlush(tooSmall) {
+		t.Error("Expecting policy to withhold a batch below MinBatchSize")
+	}
+
+	timedOut := Batch{Size: 4, Age: time.Hour}
+	if !policy.ShouldFlush(timedOut) {
+		t.Error("Expecting policy to flush once MinBatchSize and timeout are met")
+	}
+
+	full := Batch{Size: 8, Age: 0}
+	if !policy.ShouldFlush(full) {
+		t.Error("Expecting policy to flush once MaxBatchSize is reached")
+	}
+}
+
+// TestAdaptiveTimeoutPolicyAdjustsTowardsBounds checks that
+// AdaptiveTimeoutPolicy shrinks its timeout after full batches and grows
+// it after batches that didn't fill up, without crossing its bounds.
+func TestAdaptiveTimeoutPolicyAdjustsTowardsBounds(t *testing.T) {
+	policy := NewAdaptiveTimeoutPolicy(
+		8, 10*time.Millisecond, 100*time.Millisecond, 0.5,
+	)
+
+	if got := policy.NextTimeout(Batch{}); got != 100*time.Millisecond {
+		t.Errorf("Expecting initial timeout of 100ms, got %v", got)
+	}
+
+	policy.OnBatchSent(Batch{Size: 8})
+	if got := policy.currentTimeout(); got != 50*time.Millisecond {
+		t.Errorf("Expecting timeout to shrink to 50ms after a full batch, got %v", got)
+	}
+
+	policy.OnBatchSent(Batch{Size: 1})
+	if got := policy.currentTimeout(); got != 75*time.Millisecond {
+		t.Errorf("Expecting timeout to grow to 75ms after a partial batch, got %v", got)
+	}
+}
+
 // BenchmarkSendRequestParallel benchmarks the parallelism of the
 // RequestBatcher
 func BenchmarkSendRequestParallel(b *testing.B) {
@@ -155,7 +645,7 @@ func BenchmarkSendRequestParallel(b *testing.B) {
 		var reqBody interface{}
 		for pb.Next() {
 			reqBody = rand.Float32()
-			resp, err := delayedBatcher.SendRequestWithTimeout(&reqBody, idleTimeout)
+			resp, err := delayedBatcher.SendRequestWithTimeout("", &reqBody, idleTimeout)
 			if err != nil {
 				b.Errorf("Unexpected error: %v", err)
 			}
@@ -102,7 +102,7 @@ func ParseArgs() {
 }
 
 // SendF takes a batch request and sends it to the backend
-func SendF(batchReq *[]interface{}) (*[]interface{}, error) {
+func SendF(batchKey string, batchReq *[]interface{}) (*[]interface{}, error) {
 	// Write body into buffer
 	buf := bytes.NewBuffer([]byte{})
 	buf.WriteByte(byte(91)) // "["
@@ -168,8 +168,9 @@ func RootHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Register to batcher and wait on response
-	res, err := requestBatcher.SendRequestWithTimeout(&body, idleTimeout)
+	// Register to batcher and wait on response. This service fronts a
+	// single backend, so every request shares the same batch key.
+	res, err := requestBatcher.SendRequestWithTimeout("", &body, idleTimeout)
 	if err != nil {
 		msg := err.Error()
 		statusCode := http.StatusBadRequest